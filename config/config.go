@@ -62,6 +62,20 @@ func (cfg *VerifierProxyConfig) UnmarshalYAML(unmarshal func(interface{}) error)
 		Verifier: VerifierConfig{
 			MaxSkew: 5 * time.Minute,
 			MaxTTL:  5 * time.Minute,
+			CacheControl: CacheControlConfig{
+				Value: "private, no-store",
+			},
+			Refresh: RefreshConfig{
+				Path: "/refresh",
+				Signer: RefreshSignerConfig{
+					SignerParams: SignerParams{
+						Issuer:         "jwtproxy-refresh",
+						ExpirationTime: 5 * time.Minute,
+						MaxSkew:        1 * time.Minute,
+						NonceLength:    32,
+					},
+				},
+			},
 			NonceStorage: RegistrableComponentConfig{
 				Type: "local",
 				Options: map[string]interface{}{
@@ -113,13 +127,48 @@ type SignerProxyConfig struct {
 }
 
 type VerifierConfig struct {
-	Upstream        URL                          `yaml:"upstream"`
-	Audience        URL                          `yaml:"audience"`
-	MaxSkew         time.Duration                `yaml:"max_skew"`
-	MaxTTL          time.Duration                `yaml:"max_ttl"`
-	KeyServer       RegistrableComponentConfig   `yaml:"key_server"`
-	NonceStorage    RegistrableComponentConfig   `yaml:"nonce_storage"`
-	ClaimsVerifiers []RegistrableComponentConfig `yaml:"claims_verifiers"`
+	Upstream         URL                          `yaml:"upstream"`
+	Audience         URL                          `yaml:"audience"`
+	AudMustMatchHost bool                         `yaml:"aud_must_match_host"`
+	HostAudiences    map[string]URL               `yaml:"host_audiences"`
+	MaxSkew          time.Duration                `yaml:"max_skew"`
+	MaxTTL           time.Duration                `yaml:"max_ttl"`
+	KeyServer        RegistrableComponentConfig   `yaml:"key_server"`
+	NonceStorage     RegistrableComponentConfig   `yaml:"nonce_storage"`
+	ClaimsVerifiers  []RegistrableComponentConfig `yaml:"claims_verifiers"`
+	ClaimsTrailer    string                       `yaml:"claims_trailer"`
+	LogFilter        map[string]string            `yaml:"log_filter"`
+	CacheControl     CacheControlConfig           `yaml:"cache_control"`
+	Refresh          RefreshConfig                `yaml:"refresh"`
+}
+
+// RefreshConfig configures an endpoint of the verifier exchanging a valid JWT for a new one,
+// having the same claims but a renewed validity, signed using Signer.
+// Only JWTs expiring within MaxRemaining (if positive) may be refreshed, and expired JWTs are
+// accepted for an additional Grace period.
+type RefreshConfig struct {
+	Enabled      bool                `yaml:"enabled"`
+	Path         string              `yaml:"path"`
+	MaxRemaining time.Duration       `yaml:"max_remaining"`
+	Grace        time.Duration       `yaml:"grace"`
+	Signer       RefreshSignerConfig `yaml:"signer"`
+}
+
+// RefreshSignerConfig is the subset of a SignerConfig that applies to refreshed JWTs.
+type RefreshSignerConfig struct {
+	SignerParams `yaml:",inline"`
+	PrivateKey   RegistrableComponentConfig `yaml:"private_key"`
+}
+
+// CacheControlConfig configures the Cache-Control header set on the responses to authenticated
+// requests, so that shared caches do not store them. An empty Value disables it.
+// Requests whose path starts with any of the ExemptPaths are left untouched, as are responses
+// whose Cache-Control header already prevents shared caching (private or no-store), unless
+// Override is set.
+type CacheControlConfig struct {
+	Value       string   `yaml:"value"`
+	Override    bool     `yaml:"override"`
+	ExemptPaths []string `yaml:"exempt_paths"`
 }
 
 type SignerParams struct {
@@ -132,6 +181,25 @@ type SignerParams struct {
 type SignerConfig struct {
 	SignerParams `yaml:",inline"`
 	PrivateKey   RegistrableComponentConfig `yaml:"private_key"`
+	LoadShedding LoadSheddingConfig         `yaml:"load_shedding"`
+	Legacy       LegacyConfig               `yaml:"legacy"`
+}
+
+// LoadSheddingConfig configures the adaptive load shedding of the signer, based on an
+// exponentially weighted moving average of the signing latency. A zero MaxSigningLatency
+// disables it.
+type LoadSheddingConfig struct {
+	MaxSigningLatency time.Duration `yaml:"max_signing_latency"`
+	Decay             float64       `yaml:"decay"`
+}
+
+// LegacyConfig configures the signer to tell apart requests from legacy clients, that do not
+// carry any token yet, during a migration. Their tokens get the additional Claims, marking them.
+// Requests already carrying a bearer token are passed through untouched: the signer does not
+// verify it, this is left to the verifier.
+type LegacyConfig struct {
+	Enabled bool                   `yaml:"enabled"`
+	Claims  map[string]interface{} `yaml:"claims"`
 }
 
 type RegistrableComponentConfig struct {
@@ -153,6 +221,9 @@ func DefaultConfig() Config {
 					MaxSkew:        1 * time.Minute,
 					NonceLength:    32,
 				},
+				LoadShedding: LoadSheddingConfig{
+					Decay: 0.1,
+				},
 			},
 		},
 	}
@@ -46,15 +46,23 @@ func init() {
 }
 
 func Sign(req *http.Request, key *key.PrivateKey, params config.SignerParams) error {
+	return signWithClaims(req, key, params, nil)
+}
+
+// signWithClaims is like Sign, but adds the specified claims to the JWT.
+// They can not override the registered claims set by the signer.
+func signWithClaims(req *http.Request, key *key.PrivateKey, params config.SignerParams, extraClaims map[string]interface{}) error {
 	// Create Claims.
-	claims := jose.Claims{
-		"iss": params.Issuer,
-		"aud": req.URL.Scheme + "://" + req.URL.Host,
-		"iat": time.Now().Unix(),
-		"nbf": time.Now().Add(-params.MaxSkew).Unix(),
-		"exp": time.Now().Add(params.ExpirationTime).Unix(),
-		"jti": generateNonce(params.NonceLength),
+	claims := make(jose.Claims, len(extraClaims)+6)
+	for name, value := range extraClaims {
+		claims[name] = value
 	}
+	claims["iss"] = params.Issuer
+	claims["aud"] = req.URL.Scheme + "://" + req.URL.Host
+	claims["iat"] = time.Now().Unix()
+	claims["nbf"] = time.Now().Add(-params.MaxSkew).Unix()
+	claims["exp"] = time.Now().Add(params.ExpirationTime).Unix()
+	claims["jti"] = generateNonce(params.NonceLength)
 
 	// Create JWT.
 	jwt, err := jose.NewSignedJWT(claims, key.Signer())
@@ -68,7 +76,33 @@ func Sign(req *http.Request, key *key.PrivateKey, params config.SignerParams) er
 	return nil
 }
 
+// Refresh creates a new JWT having the same claims as the specified ones, except for the issuer,
+// which is the signer's one, and for the validity and nonce, which are renewed.
+func Refresh(claims jose.Claims, key *key.PrivateKey, params config.SignerParams) (string, error) {
+	refreshedClaims := make(jose.Claims, len(claims))
+	for name, value := range claims {
+		refreshedClaims[name] = value
+	}
+	refreshedClaims["iss"] = params.Issuer
+	refreshedClaims["iat"] = time.Now().Unix()
+	refreshedClaims["nbf"] = time.Now().Add(-params.MaxSkew).Unix()
+	refreshedClaims["exp"] = time.Now().Add(params.ExpirationTime).Unix()
+	refreshedClaims["jti"] = generateNonce(params.NonceLength)
+
+	jwt, err := jose.NewSignedJWT(refreshedClaims, key.Signer())
+	if err != nil {
+		return "", err
+	}
+	return jwt.Encode(), nil
+}
+
 func Verify(req *http.Request, keyServer keyserver.Reader, nonceVerifier noncestorage.NonceStorage, audience *url.URL, maxSkew time.Duration, maxTTL time.Duration) (jose.Claims, error) {
+	return verify(req, keyServer, nonceVerifier, audience, maxSkew, maxTTL, 0, 0)
+}
+
+// verify is like Verify, but still accepts JWTs that expired less than expGrace ago and, if
+// maxRemaining is positive, refuses the ones that expire later than maxRemaining from now.
+func verify(req *http.Request, keyServer keyserver.Reader, nonceVerifier noncestorage.NonceStorage, audience *url.URL, maxSkew, maxTTL, expGrace, maxRemaining time.Duration) (jose.Claims, error) {
 	// Extract token from request.
 	token, err := oidc.ExtractBearerToken(req)
 	if err != nil {
@@ -101,9 +135,12 @@ func Verify(req *http.Request, keyServer keyserver.Reader, nonceVerifier noncest
 		return nil, errors.New("Missing or invalid 'aud' claim")
 	}
 	exp, exists, err := claims.TimeClaim("exp")
-	if !exists || err != nil || exp.Before(now) {
+	if !exists || err != nil || exp.Add(expGrace).Before(now) {
 		return nil, errors.New("Missing or invalid 'exp' claim")
 	}
+	if maxRemaining > 0 && exp.Sub(now) > maxRemaining {
+		return nil, errors.New("Invalid 'exp' claim (too far in the future)")
+	}
 	nbf, exists, err := claims.TimeClaim("nbf")
 	if !exists || err != nil || nbf.After(now) {
 		return nil, errors.New("Missing or invalid 'nbf' claim")
@@ -116,7 +153,7 @@ func Verify(req *http.Request, keyServer keyserver.Reader, nonceVerifier noncest
 		return nil, errors.New("Invalid 'exp' claim (too long)")
 	}
 	jti, exists, err := claims.StringClaim("jti")
-	if !exists || err != nil || !nonceVerifier.Verify(jti, exp) {
+	if !exists || err != nil || !nonceVerifier.Verify(jti, exp.Add(expGrace)) {
 		return nil, errors.New("Missing or invalid 'jti' claim")
 	}
 
@@ -15,9 +15,13 @@
 package jwt
 
 import (
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/url"
@@ -27,9 +31,16 @@ import (
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/key"
 	"github.com/coreos/go-oidc/oidc"
+	"github.com/coreos/goproxy"
 	"github.com/coreos/jwtproxy/config"
+	_ "github.com/coreos/jwtproxy/jwt/claims/static"
+	"github.com/coreos/jwtproxy/jwt/keyserver"
+	"github.com/coreos/jwtproxy/jwt/noncestorage"
+	_ "github.com/coreos/jwtproxy/jwt/noncestorage/local"
+	"github.com/coreos/jwtproxy/jwt/privatekey"
 	"github.com/coreos/jwtproxy/stop"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 const privateKey = `
@@ -87,6 +98,20 @@ func (ts *testService) Stop() <-chan struct{} {
 	return stop.AlreadyDone
 }
 
+func init() {
+	// Let the proxy handlers use test services as key server, nonce storage and
+	// private key.
+	privatekey.Register("test", func(config.RegistrableComponentConfig, config.SignerParams) (privatekey.PrivateKey, error) {
+		return newSignAndVerifyParams().services, nil
+	})
+	keyserver.RegisterReader("test", func(config.RegistrableComponentConfig) (keyserver.Reader, error) {
+		return newSignAndVerifyParams().services, nil
+	})
+	noncestorage.Register("test", func(config.RegistrableComponentConfig) (noncestorage.NonceStorage, error) {
+		return newSignAndVerifyParams().services, nil
+	})
+}
+
 func TestJWT(t *testing.T) {
 	// Create a request to sign.
 	req, _ := http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
@@ -201,6 +226,318 @@ func TestJWT(t *testing.T) {
 	assert.Error(t, signAndVerify(t, req, cfg, nil))
 }
 
+func TestLegacy(t *testing.T) {
+	p := newSignAndVerifyParams()
+
+	// Legacy claims may be nested, as decoded from the configuration.
+	var legacyConfig config.LegacyConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("claims: {legacy: true, migration: {phase: 1, teams: [a, {b: c}]}}"), &legacyConfig))
+	legacyClaims, err := jsonValue(legacyConfig.Claims)
+	assert.Nil(t, err)
+	_, err = jsonValue(map[interface{}]interface{}{1: "a"})
+	assert.Error(t, err)
+	_, err = NewJWTSignerHandler(config.SignerConfig{
+		PrivateKey: config.RegistrableComponentConfig{Type: "test"},
+		Legacy:     config.LegacyConfig{Enabled: true},
+	})
+	assert.Error(t, err)
+
+	// Requests without a token get one, carrying the legacy marker.
+	handler := signerHandler(p.signerParams, p.services, nil, legacyClaims.(map[string]interface{}))
+	req, _ := http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
+	_, resp := handler(req, nil)
+	assert.Nil(t, resp)
+	claims, err := Verify(req, p.services, p.services, p.aud, p.maxSkew, p.maxTTL)
+	assert.Nil(t, err)
+	assert.Equal(t, true, claims["legacy"])
+	assert.Equal(t, map[string]interface{}{
+		"phase": float64(1),
+		"teams": []interface{}{"a", map[string]interface{}{"b": "c"}},
+	}, claims["migration"])
+
+	// Requests carrying a token are passed through untouched.
+	req, _ = http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
+	req.Header.Set("Authorization", "Bearer x")
+	_, resp = handler(req, nil)
+	assert.Nil(t, resp)
+	assert.Equal(t, []string{"Bearer x"}, req.Header["Authorization"])
+
+	// Without legacy mode, tokens are not marked.
+	handler = signerHandler(p.signerParams, p.services, nil, nil)
+	req, _ = http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
+	_, resp = handler(req, nil)
+	assert.Nil(t, resp)
+	claims, err = Verify(req, p.services, p.services, p.aud, p.maxSkew, p.maxTTL)
+	assert.Nil(t, err)
+	_, marked := claims["legacy"]
+	assert.False(t, marked)
+}
+
+func TestRefresh(t *testing.T) {
+	p := *newSignAndVerifyParams()
+	pk, _ := p.services.GetPrivateKey()
+
+	// Expired JWTs are only accepted during the grace period.
+	p.signerParams.ExpirationTime = -time.Second
+	req, _ := http.NewRequest("GET", "http://foo.bar:6666/refresh", nil)
+	assert.Nil(t, Sign(req, pk, p.signerParams))
+	_, err := verify(req, p.services, p.services, p.aud, p.maxSkew, p.maxTTL, 0, 0)
+	assert.Error(t, err)
+	claims, err := verify(req, p.services, p.services, p.aud, p.maxSkew, p.maxTTL, time.Minute, 0)
+	assert.Nil(t, err)
+
+	// JWTs that are too far from their expiration can not be refreshed.
+	p.signerParams.ExpirationTime = 5 * time.Minute
+	req, _ = http.NewRequest("GET", "http://foo.bar:6666/refresh", nil)
+	assert.Nil(t, Sign(req, pk, p.signerParams))
+	_, err = verify(req, p.services, p.services, p.aud, p.maxSkew, p.maxTTL, 0, time.Minute)
+	assert.Error(t, err)
+
+	// The refreshed JWT has the same claims and a renewed validity.
+	claims.Add("sub", "foo")
+	p.signerParams.ExpirationTime = time.Minute
+	token, err := Refresh(claims, pk, p.signerParams)
+	assert.Nil(t, err)
+
+	req, _ = http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	refreshedClaims, err := Verify(req, p.services, p.services, p.aud, p.maxSkew, p.maxTTL)
+	assert.Nil(t, err)
+	assert.Equal(t, claims["aud"], refreshedClaims["aud"])
+	assert.Equal(t, "foo", refreshedClaims["sub"])
+	assert.NotEqual(t, claims["jti"], refreshedClaims["jti"])
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	p := newSignAndVerifyParams()
+	upstream, _ := url.Parse("http://upstream")
+	verifier, err := NewJWTVerifierHandler(config.VerifierConfig{
+		Upstream:     config.URL{URL: upstream},
+		Audience:     config.URL{URL: p.aud},
+		KeyServer:    config.RegistrableComponentConfig{Type: "test"},
+		NonceStorage: config.RegistrableComponentConfig{Type: "local"},
+		MaxSkew:      p.maxSkew,
+		MaxTTL:       p.maxTTL,
+		ClaimsVerifiers: []config.RegistrableComponentConfig{
+			{Type: "static", Options: map[string]interface{}{"tenant": "acme"}},
+		},
+		Refresh: config.RefreshConfig{
+			Enabled: true,
+			Path:    "/refresh",
+			Signer: config.RefreshSignerConfig{
+				SignerParams: config.SignerParams{
+					Issuer:         "refresher",
+					ExpirationTime: time.Minute,
+					MaxSkew:        time.Minute,
+					NonceLength:    8,
+				},
+				PrivateKey: config.RegistrableComponentConfig{Type: "test"},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	defer verifier.Stop()
+
+	// newRequest signs a request to the specified path, for the specified tenant.
+	newRequest := func(path, tenant string) *http.Request {
+		req, _ := http.NewRequest("POST", "http://foo.bar:6666"+path, nil)
+		pk, _ := p.services.GetPrivateKey()
+		assert.Nil(t, signWithClaims(req, pk, p.signerParams, map[string]interface{}{"tenant": tenant}))
+		return req
+	}
+	handle := func(req *http.Request) *http.Response {
+		_, resp := verifier.Handler(req, &goproxy.ProxyCtx{Req: req})
+		return resp
+	}
+
+	// Refresh requests are answered by the verifier itself with a new JWT.
+	req := newRequest("/refresh", "acme")
+	resp := handle(req)
+	if !assert.NotNil(t, resp) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	encodedBody, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(encodedBody, &body))
+
+	// The refreshed JWT keeps the claims, but is issued by the refresh signer.
+	refresher := *p.services
+	refresher.issuer = "refresher"
+	refreshedReq, _ := http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
+	refreshedReq.Header.Set("Authorization", "Bearer "+body.Token)
+	refreshedClaims, err := Verify(refreshedReq, &refresher, &refresher, p.aud, p.maxSkew, p.maxTTL)
+	assert.Nil(t, err)
+	assert.Equal(t, "refresher", refreshedClaims["iss"])
+	assert.Equal(t, "acme", refreshedClaims["tenant"])
+
+	// A JWT can only be refreshed once, as its nonce has been used.
+	resp = handle(req)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Claims verifiers apply to refresh requests.
+	resp = handle(newRequest("/refresh", "other"))
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Other paths are routed to the upstream.
+	req = newRequest("/refresh/other", "acme")
+	assert.Nil(t, handle(req))
+	assert.Equal(t, "upstream", req.URL.Host)
+}
+
+func TestClaimsTrailer(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://foo.bar:6666/ez", nil)
+	claims := jose.Claims{"iss": "issuer", "sub": "foo"}
+
+	// Trailer is announced, set, and forces the response to be chunked.
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Length": {"4"}}}
+	addClaimsTrailer(resp, req, "jwt-claims", claims)
+	assert.Equal(t, "Jwt-Claims", resp.Header.Get("Trailer"))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+
+	encodedClaims, err := base64.RawURLEncoding.DecodeString(resp.Header.Get(http.TrailerPrefix + "Jwt-Claims"))
+	assert.Nil(t, err)
+	var decodedClaims jose.Claims
+	assert.Nil(t, json.Unmarshal(encodedClaims, &decodedClaims))
+	assert.Equal(t, claims, decodedClaims)
+
+	// Responses without body can not carry trailers.
+	resp = &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}}
+	addClaimsTrailer(resp, req, "jwt-claims", claims)
+	assert.Empty(t, resp.Header.Get("Trailer"))
+
+	// HTTP/1.0 clients do not support chunked bodies, thus trailers.
+	req.ProtoMajor, req.ProtoMinor = 1, 0
+	resp = &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Length": {"4"}}}
+	addClaimsTrailer(resp, req, "jwt-claims", claims)
+	assert.Empty(t, resp.Header.Get("Trailer"))
+	assert.Equal(t, "4", resp.Header.Get("Content-Length"))
+}
+
+func TestCacheControl(t *testing.T) {
+	p := newSignAndVerifyParams()
+	upstream, _ := url.Parse("http://upstream")
+	newVerifier := func(cacheControl config.CacheControlConfig) *StoppableProxyHandler {
+		verifier, err := NewJWTVerifierHandler(config.VerifierConfig{
+			Upstream:     config.URL{URL: upstream},
+			Audience:     config.URL{URL: p.aud},
+			KeyServer:    config.RegistrableComponentConfig{Type: "test"},
+			NonceStorage: config.RegistrableComponentConfig{Type: "test"},
+			MaxSkew:      p.maxSkew,
+			MaxTTL:       p.maxTTL,
+			CacheControl: cacheControl,
+		})
+		assert.Nil(t, err)
+		return verifier
+	}
+
+	// proxy sends a request to the verifier, signed if asked to, and returns the Cache-Control
+	// header of the response. The upstream answers with the specified one, if verified.
+	proxy := func(verifier *StoppableProxyHandler, target string, sign bool, upstreamCacheControl string) string {
+		req, _ := http.NewRequest("GET", target, nil)
+		if sign {
+			pk, _ := p.services.GetPrivateKey()
+			assert.Nil(t, Sign(req, pk, p.signerParams))
+		}
+
+		ctx := &goproxy.ProxyCtx{Req: req}
+		req, resp := verifier.Handler(req, ctx)
+		if resp == nil {
+			resp = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+			if upstreamCacheControl != "" {
+				resp.Header.Set("Cache-Control", upstreamCacheControl)
+			}
+		}
+		return verifier.ResponseHandler(resp, ctx).Header.Get("Cache-Control")
+	}
+
+	verifier := newVerifier(config.CacheControlConfig{Value: "private, no-store", ExemptPaths: []string{"/public"}})
+	defer verifier.Stop()
+
+	// Responses to authenticated requests are kept away from shared caches, even if the upstream
+	// allowed it, unless the path is exempt.
+	assert.Equal(t, "private, no-store", proxy(verifier, "http://foo.bar:6666/private", true, ""))
+	assert.Equal(t, "private, no-store", proxy(verifier, "http://foo.bar:6666/private", true, "public, max-age=60"))
+	assert.Equal(t, "private, no-store", proxy(verifier, "http://foo.bar:6666/private", true, `no-cache, private="Set-Cookie"`))
+	assert.Equal(t, "public, max-age=60", proxy(verifier, "http://foo.bar:6666/public/logo.png", true, "public, max-age=60"))
+	assert.Empty(t, proxy(verifier, "http://foo.bar:6666/public/logo.png", true, ""))
+
+	// The upstream's header is kept if it already prevents shared caching.
+	assert.Equal(t, "private, max-age=60", proxy(verifier, "http://foo.bar:6666/private", true, "private, max-age=60"))
+	assert.Equal(t, "No-Store", proxy(verifier, "http://foo.bar:6666/private", true, "No-Store"))
+
+	// Unauthenticated and rejected requests are answered by the verifier itself.
+	assert.Empty(t, proxy(verifier, "http://foo.bar:6666/private", false, ""))
+	assert.Empty(t, proxy(verifier, "http://other.host/private", true, ""))
+
+	// The upstream's header may be overridden altogether.
+	overrider := newVerifier(config.CacheControlConfig{Value: "private, no-store", Override: true})
+	defer overrider.Stop()
+	assert.Equal(t, "private, no-store", proxy(overrider, "http://foo.bar:6666/private", true, "private, max-age=60"))
+
+	// An empty value disables the header altogether.
+	disabled := newVerifier(config.CacheControlConfig{})
+	defer disabled.Stop()
+	assert.Empty(t, proxy(disabled, "http://foo.bar:6666/private", true, ""))
+}
+
+func TestHostAudience(t *testing.T) {
+	mappedAudience, _ := url.Parse("https://service-a/")
+	hostAudiences := map[string]*url.URL{"service-a.internal": mappedAudience}
+
+	// Mapped host.
+	req, _ := http.NewRequest("GET", "http://Service-A.internal/ez", nil)
+	assert.Equal(t, mappedAudience, hostAudience(req, hostAudiences))
+
+	// Derived from the host.
+	req, _ = http.NewRequest("GET", "http://service-b.internal:6666/ez", nil)
+	assert.Equal(t, "http://service-b.internal:6666", hostAudience(req, hostAudiences).String())
+
+	req.TLS = &tls.ConnectionState{}
+	assert.Equal(t, "https://service-b.internal:6666", hostAudience(req, hostAudiences).String())
+
+	// A token signed for a host can't be used against another one.
+	cfg := *newSignAndVerifyParams()
+	req, _ = http.NewRequest("GET", "http://service-b.internal/ez", nil)
+	cfg.aud = hostAudience(req, hostAudiences)
+	assert.Nil(t, signAndVerify(t, req, cfg, nil))
+
+	req, _ = http.NewRequest("GET", "http://service-b.internal/ez", nil)
+	req.Host = "service-c.internal"
+	cfg.aud = hostAudience(req, hostAudiences)
+	assert.Error(t, signAndVerify(t, req, cfg, nil))
+}
+
+func TestClaimsMatch(t *testing.T) {
+	claims := jose.Claims{
+		"iss":    "issuer",
+		"tenant": "acme",
+		"groups": []interface{}{"admins", "users"},
+		"level":  float64(42),
+	}
+
+	assert.True(t, claimsMatch(claims, map[string]string{}))
+	assert.True(t, claimsMatch(claims, map[string]string{"tenant": "acme"}))
+	assert.True(t, claimsMatch(claims, map[string]string{"tenant": "acme", "groups": "users", "level": "42"}))
+	assert.False(t, claimsMatch(claims, map[string]string{"tenant": "other"}))
+	assert.False(t, claimsMatch(claims, map[string]string{"tenant": "acme", "groups": "guests"}))
+	assert.False(t, claimsMatch(claims, map[string]string{"sub": "acme"}))
+
+	// Only the filtered claims, the subject and the issuer get logged.
+	assert.Equal(t, jose.Claims{"iss": "issuer", "tenant": "acme"}, loggedClaims(claims, map[string]string{"tenant": "acme"}))
+	assert.Equal(t, jose.Claims{"iss": "issuer", "groups": claims["groups"]}, loggedClaims(claims, map[string]string{"groups": "users", "sub": "acme"}))
+}
+
 type signAndVerifyParams struct {
 	services *testService
 
@@ -213,6 +550,40 @@ type signAndVerifyParams struct {
 	maxTTL  time.Duration
 }
 
+func newSignAndVerifyParams() *signAndVerifyParams {
+	// Create a public/private key pair used to sign/verify.
+	pkb, _ := pem.Decode([]byte(privateKey))
+	pkr, _ := x509.ParsePKCS1PrivateKey(pkb.Bytes)
+	pk := &key.PrivateKey{
+		KeyID:      "foo",
+		PrivateKey: pkr,
+	}
+
+	// Create a test service to act as a keyserver and as a privatekey provider.
+	services := &testService{
+		privkey:        pk,
+		sendBadPrivKey: false,
+		issuer:         "issuer",
+		sendBadPubKey:  false,
+		refuseNonce:    false,
+	}
+
+	// Create a default (and valid) configuration to sign and verify requests.
+	aud, _ := url.Parse("http://foo.bar:6666/ez")
+	return &signAndVerifyParams{
+		services: services,
+		signerParams: config.SignerParams{
+			Issuer:         services.issuer,
+			ExpirationTime: 1 * time.Minute,
+			MaxSkew:        1 * time.Minute,
+			NonceLength:    8,
+		},
+		aud:     aud,
+		maxSkew: time.Minute,
+		maxTTL:  5 * time.Minute,
+	}
+}
+
 type requestModifier func(req *http.Request)
 
 func signAndVerify(t *testing.T, req *http.Request, p signAndVerifyParams, modify requestModifier) error {
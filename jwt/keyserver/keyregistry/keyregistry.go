@@ -125,6 +125,10 @@ func (krc *client) PublishPublicKey(key *key.PublicKey, policy *keyserver.KeyPol
 			log.Debug("Adding rotation time: ", policy.RotationPolicy)
 			queryParams.Add("rotation", strconv.Itoa(int(policy.RotationPolicy.Seconds())))
 		}
+		if policy.Generation != nil {
+			log.Debug("Adding key set generation: ", *policy.Generation)
+			queryParams.Add("generation", strconv.FormatUint(*policy.Generation, 10))
+		}
 		publishURL.RawQuery = queryParams.Encode()
 
 		resp, err := krc.signAndDo("PUT", publishURL, bytes.NewReader(body), signingKey)
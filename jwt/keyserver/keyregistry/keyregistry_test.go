@@ -0,0 +1,69 @@
+// Copyright 2016 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyregistry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/key"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/jwtproxy/config"
+	"github.com/coreos/jwtproxy/jwt/keyserver"
+)
+
+func TestPublishGeneration(t *testing.T) {
+	queries := make(chan url.Values, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+	}))
+	defer server.Close()
+
+	registry, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	krc := &client{
+		registry: registry,
+		signerParams: config.SignerParams{
+			Issuer:         "issuer",
+			ExpirationTime: time.Minute,
+			MaxSkew:        time.Minute,
+			NonceLength:    8,
+		},
+		inFlight:   &sync.WaitGroup{},
+		stopping:   make(chan struct{}),
+		httpClient: http.DefaultClient,
+	}
+	defer krc.Stop()
+
+	privateKey, err := key.GeneratePrivateKey()
+	assert.Nil(t, err)
+	publicKey := key.NewPublicKey(privateKey.JWK())
+
+	// The generation is sent along with the key when there is one.
+	generation := uint64(42)
+	policy := &keyserver.KeyPolicy{Generation: &generation}
+	assert.Nil(t, <-krc.PublishPublicKey(publicKey, policy, privateKey).Result())
+	assert.Equal(t, "42", (<-queries).Get("generation"))
+
+	// And omitted otherwise.
+	assert.Nil(t, <-krc.PublishPublicKey(publicKey, &keyserver.KeyPolicy{}, privateKey).Result())
+	_, ok := (<-queries)["generation"]
+	assert.False(t, ok)
+}
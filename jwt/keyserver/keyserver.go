@@ -42,6 +42,9 @@ type Reader interface {
 type KeyPolicy struct {
 	Expiration     *time.Time
 	RotationPolicy *time.Duration
+	// Generation is a counter incremented every time a new key is published by
+	// the signer, which allows verifiers to cheaply detect key changes.
+	Generation *uint64
 }
 
 type Manager interface {
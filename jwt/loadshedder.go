@@ -0,0 +1,72 @@
+// Copyright 2016 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/coreos/jwtproxy/config"
+)
+
+// loadShedder rejects signing requests when the exponentially weighted moving average of the
+// signing latency exceeds a configured threshold.
+//
+// Requests are not all rejected above the threshold: they are shed with a probability that grows
+// with the overshoot. The ones that still go through keep feeding the average, which lets it
+// decrease once the pressure is gone.
+// A nil *loadShedder never sheds.
+type loadShedder struct {
+	maxLatency float64
+	decay      float64
+
+	lock    sync.Mutex
+	average float64
+	rand    *rand.Rand
+}
+
+func newLoadShedder(cfg config.LoadSheddingConfig) *loadShedder {
+	return &loadShedder{
+		maxLatency: float64(cfg.MaxSigningLatency),
+		decay:      cfg.Decay,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (ls *loadShedder) shouldShed() bool {
+	if ls == nil {
+		return false
+	}
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	if ls.average <= ls.maxLatency {
+		return false
+	}
+	return ls.rand.Float64() < 1-ls.maxLatency/ls.average
+}
+
+func (ls *loadShedder) observe(latency time.Duration) {
+	if ls == nil {
+		return
+	}
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	ls.average = ls.decay*float64(latency) + (1-ls.decay)*ls.average
+}
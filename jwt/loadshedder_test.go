@@ -0,0 +1,76 @@
+// Copyright 2016 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwt
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/jwtproxy/config"
+)
+
+func TestLoadShedder(t *testing.T) {
+	const trials = 10000
+
+	tests := []struct {
+		name    string
+		decay   float64
+		samples []time.Duration
+		minShed float64
+		maxShed float64
+	}{
+		{"no samples", 1, nil, 0, 0},
+		{"below threshold", 1, []time.Duration{5 * time.Millisecond}, 0, 0},
+		{"at threshold", 1, []time.Duration{10 * time.Millisecond}, 0, 0},
+		{"twice the threshold", 1, []time.Duration{20 * time.Millisecond}, 0.45, 0.55},
+		{"ten times the threshold", 1, []time.Duration{100 * time.Millisecond}, 0.87, 0.93},
+		{"recovered", 1, []time.Duration{100 * time.Millisecond, 5 * time.Millisecond}, 0, 0},
+		{"averaged overshoot", 0.5, []time.Duration{5 * time.Millisecond, 35 * time.Millisecond}, 0.45, 0.55},
+		{"averaged recovery", 0.5, []time.Duration{
+			100 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond,
+			5 * time.Millisecond, 5 * time.Millisecond,
+		}, 0, 0},
+	}
+
+	for _, test := range tests {
+		ls := newLoadShedder(config.LoadSheddingConfig{
+			MaxSigningLatency: 10 * time.Millisecond,
+			Decay:             test.decay,
+		})
+		ls.rand = rand.New(rand.NewSource(1))
+
+		for _, sample := range test.samples {
+			ls.observe(sample)
+		}
+
+		shed := 0
+		for i := 0; i < trials; i++ {
+			if ls.shouldShed() {
+				shed++
+			}
+		}
+
+		ratio := float64(shed) / trials
+		assert.True(t, ratio >= test.minShed && ratio <= test.maxShed, "%s: shed ratio %f not in [%f, %f]", test.name, ratio, test.minShed, test.maxShed)
+	}
+
+	// A nil load shedder never sheds.
+	var ls *loadShedder
+	ls.observe(time.Hour)
+	assert.False(t, ls.shouldShed())
+}
@@ -15,14 +15,14 @@
 package autogenerated
 
 import (
-	"crypto"
 	"crypto/rsa"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -40,25 +40,74 @@ func init() {
 	privatekey.Register("autogenerated", constructor)
 }
 
+const (
+	// How many previously active keys are kept in the key ring. Keys are
+	// published with an expiration of twice the rotation interval, so they
+	// remain valid for up to two rotations.
+	maxRetiredKeys = 2
+
+	// How many keys we generate before giving up when their ID collides with
+	// the ones in the key ring.
+	maxKeyGenerationAttempts = 3
+)
+
+var errKeyIDCollision = errors.New("Generated key ID is already used in the key ring")
+
 type Autogenerated struct {
-	active  *key.PrivateKey
-	pending *key.PrivateKey
-	manager keyserver.Manager
-	keyLock sync.Mutex
-	stopCh  chan struct{}
-	doneCh  chan struct{}
-	keyPath string
+	active    *key.PrivateKey
+	pending   *key.PrivateKey
+	retired   []string
+	manager   keyserver.Manager
+	keyLock   sync.Mutex
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	keyPath   string
+	generator *generator
+	keyID     keyIDScheme
+	issuer    string
+
+	// Whether to generate another key, rather than failing, when the ID of a
+	// generated key is already used in the key ring.
+	regenerateOnCollision bool
+
+	// Key servers to which published keys must have propagated before being
+	// made active.
+	propagationReaders []keyserver.Reader
+	propagationTimeout time.Duration
+	propagationPoll    time.Duration
+
+	// Key set generation, incremented for every new key. It is only tracked and
+	// published if generationPath is set.
+	generation     uint64
+	generationPath string
 }
 
 type Config struct {
-	RotationInterval time.Duration                     `yaml:"rotate_every"`
-	KeyServer        config.RegistrableComponentConfig `yaml:"key_server"`
-	KeyFolder        string                            `yaml:"key_folder"`
+	RotationInterval     time.Duration                     `yaml:"rotate_every"`
+	KeyServer            config.RegistrableComponentConfig `yaml:"key_server"`
+	KeyFolder            string                            `yaml:"key_folder"`
+	PublishGeneration    bool                              `yaml:"publish_generation"`
+	KeyGenerationWorkers int                               `yaml:"key_generation_workers"`
+	Propagation          PropagationConfig                 `yaml:"propagation"`
+	OnKeyIDCollision     string                            `yaml:"on_key_id_collision"`
+}
+
+// PropagationConfig lists key servers (e.g. the registries of the other
+// regions) that must all serve a newly published key before it gets used for
+// signing, and how long to wait for it.
+type PropagationConfig struct {
+	KeyServers []config.RegistrableComponentConfig `yaml:"key_servers"`
+	Timeout    time.Duration                       `yaml:"timeout"`
 }
 
 func constructor(registrableComponentConfig config.RegistrableComponentConfig, signerParams config.SignerParams) (privatekey.PrivateKey, error) {
 	cfg := Config{
-		RotationInterval: 12 * time.Hour,
+		RotationInterval:     12 * time.Hour,
+		KeyGenerationWorkers: 1,
+		Propagation: PropagationConfig{
+			Timeout: 1 * time.Minute,
+		},
+		OnKeyIDCollision: "regenerate",
 	}
 	bytes, err := yaml.Marshal(registrableComponentConfig.Options)
 	if err != nil {
@@ -68,13 +117,44 @@ func constructor(registrableComponentConfig config.RegistrableComponentConfig, s
 	if err != nil {
 		return nil, err
 	}
+	if cfg.KeyGenerationWorkers < 1 {
+		return nil, errors.New("at least one key generation worker is required")
+	}
+	if cfg.OnKeyIDCollision != "fail" && cfg.OnKeyIDCollision != "regenerate" {
+		return nil, fmt.Errorf("unknown key ID collision policy %q", cfg.OnKeyIDCollision)
+	}
+
+	privateKeyPath := keyPath(cfg.KeyFolder, signerParams.Issuer)
+
+	// Resume from the last generation we published, if any. Starting over would
+	// make the generation go backward, so refuse to start if it can't be read.
+	var generation uint64
+	var generationPath string
+	if cfg.PublishGeneration {
+		generationPath = strings.TrimSuffix(privateKeyPath, path.Ext(privateKeyPath)) + ".generation"
+		generation, err = resumeGeneration(generationPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load key set generation: %s", err)
+		}
+	}
 
 	manager, err := keyserver.NewManager(cfg.KeyServer, signerParams)
 	if err != nil {
 		return nil, err
 	}
 
-	privateKeyPath := keyPath(cfg.KeyFolder, signerParams.Issuer)
+	propagationReaders := make([]keyserver.Reader, 0, len(cfg.Propagation.KeyServers))
+	for _, readerConfig := range cfg.Propagation.KeyServers {
+		reader, err := keyserver.NewReader(readerConfig)
+		if err != nil {
+			for _, reader := range propagationReaders {
+				reader.Stop()
+			}
+			manager.Stop()
+			return nil, fmt.Errorf("Unable to construct propagation key server: %s", err)
+		}
+		propagationReaders = append(propagationReaders, reader)
+	}
 
 	var activeKey *key.PrivateKey
 
@@ -102,14 +182,28 @@ func constructor(registrableComponentConfig config.RegistrableComponentConfig, s
 	}
 
 	ag := &Autogenerated{
-		active:  activeKey,
-		pending: nil,
-		manager: manager,
-		stopCh:  make(chan struct{}),
-		doneCh:  make(chan struct{}),
-		keyPath: privateKeyPath,
+		active:    activeKey,
+		pending:   nil,
+		manager:   manager,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+		keyPath:   privateKeyPath,
+		generator: sharedGenerator,
+		keyID:     thumbprintKeyID,
+		issuer:    signerParams.Issuer,
+
+		regenerateOnCollision: cfg.OnKeyIDCollision == "regenerate",
+
+		propagationReaders: propagationReaders,
+		propagationTimeout: cfg.Propagation.Timeout,
+		propagationPoll:    1 * time.Second,
+
+		generation:     generation,
+		generationPath: generationPath,
 	}
 
+	sharedGenerator.startWorkers(cfg.KeyGenerationWorkers)
+
 	publicationResult := keyserver.NewPublishResult()
 	if activeKey == nil {
 		log.Debug("Boostrapping publication with a new key")
@@ -211,40 +305,153 @@ func savePrivateKey(key *key.PrivateKey, keyPath string) error {
 	return nil
 }
 
+// resumeGeneration returns the last persisted key set generation, or zero if
+// none was ever persisted.
+func resumeGeneration(generationPath string) (uint64, error) {
+	generation, err := loadGeneration(generationPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return generation, err
+}
+
+func loadGeneration(generationPath string) (uint64, error) {
+	contents, err := ioutil.ReadFile(generationPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+}
+
+func saveGeneration(generation uint64, generationPath string) error {
+	err := os.MkdirAll(path.Dir(generationPath), os.ModeDir|0755)
+	if err != nil {
+		log.Warn("Unable to create key set generation file directory: ", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(generationPath, []byte(strconv.FormatUint(generation, 10)), 0600)
+	if err != nil {
+		log.Warn("Unable to save key set generation: ", err)
+		return err
+	}
+	return nil
+}
+
 // Attempt to publish a new key, if the signing key is nil we will self-sign
 // the key.
+// The key is generated asynchronously, by the shared generator's worker pool.
 func (ag *Autogenerated) attemptPublish(signingKey *key.PrivateKey, rotateInterval time.Duration) *keyserver.PublishResult {
-	// We want to do this outside of the lock since it may take some time.
-	candidate, err := key.GeneratePrivateKey()
+	publicationResult := keyserver.NewPublishResult()
 
-	candidateJwk := jose.JSONWebKey{
-		Key:       candidate.PrivateKey,
-		KeyID:     candidate.KeyID,
-		Algorithm: "rsa",
-		Use:       "",
-	}
-	thumbprint, err := candidateJwk.Thumbprint(crypto.SHA256)
-	candidate.KeyID = base64.URLEncoding.EncodeToString(thumbprint)
+	go func() {
+		var candidate *key.PrivateKey
+		var managerResult *keyserver.PublishResult
+		for attempt := 1; managerResult == nil; attempt++ {
+			var err error
+			candidate, err = ag.awaitCandidate(publicationResult.WaitForCancel())
+			if err != nil {
+				publicationResult.SetError(err)
+				return
+			}
 
-	if err != nil {
-		immediateResult := keyserver.NewPublishResult()
-		immediateResult.SetError(fmt.Errorf("Unable to generate new key: %s", err))
-		return immediateResult
+			managerResult, err = ag.publishCandidate(candidate, signingKey, rotateInterval)
+			if err == errKeyIDCollision && ag.regenerateOnCollision && attempt < maxKeyGenerationAttempts {
+				log.WithField("keyID", candidate.ID()).Warn("Generated key ID collides with the key ring, generating another key")
+			} else if err != nil {
+				publicationResult.SetError(err)
+				return
+			}
+		}
+
+		select {
+		case err := <-managerResult.Result():
+			if err == nil && len(ag.propagationReaders) > 0 {
+				err = ag.awaitPropagation(candidate, publicationResult.WaitForCancel())
+			}
+			publicationResult.SetError(err)
+		case <-publicationResult.WaitForCancel():
+			managerResult.Cancel()
+			publicationResult.SetError(<-managerResult.Result())
+		}
+	}()
+
+	return publicationResult
+}
+
+// Wait for the generator to deliver a new key.
+func (ag *Autogenerated) awaitCandidate(cancel <-chan struct{}) (*key.PrivateKey, error) {
+	select {
+	case generated := <-ag.generator.Generate(ag.keyID, cancel):
+		if generated.err == errGenerationCanceled {
+			return nil, generated.err
+		} else if generated.err != nil {
+			return nil, fmt.Errorf("Unable to generate new key: %s", generated.err)
+		}
+
+		// The publication may have been canceled while the key was delivered.
+		select {
+		case <-cancel:
+			return nil, errGenerationCanceled
+		default:
+		}
+		return generated.key, nil
+	case <-cancel:
+		return nil, errGenerationCanceled
 	}
+}
 
-	if ag.pending != nil {
-		log.Debug("Best effort revoking unapproved key due to rotation")
-		go ag.revokeKey(ag.pending)
+// Poll the propagation key servers until they all serve the published key.
+// The current key keeps signing meanwhile, which only works if the key server
+// that approved the new key did not revoke the current one: keys are published
+// expiring after two rotation intervals, which leaves room for the wait.
+// If the key servers do not serve the key within the timeout, it gets used
+// anyway rather than stalling the rotation.
+func (ag *Autogenerated) awaitPropagation(published *key.PrivateKey, cancel <-chan struct{}) error {
+	propagationLog := log.WithField("keyID", published.ID()[0:10])
+	propagationLog.Debug("Waiting for key to propagate")
+
+	timeout := time.NewTimer(ag.propagationTimeout)
+	defer timeout.Stop()
+
+	pollPeriod := time.NewTicker(ag.propagationPoll)
+	defer pollPeriod.Stop()
+
+	missing := ag.propagationReaders
+	for {
+		stillMissing := make([]keyserver.Reader, 0, len(missing))
+		for _, reader := range missing {
+			if _, err := reader.GetPublicKey(ag.issuer, published.ID()); err != nil {
+				stillMissing = append(stillMissing, reader)
+			}
+		}
+		missing = stillMissing
+
+		if len(missing) == 0 {
+			propagationLog.Debug("Key propagated to all key servers")
+			return nil
+		}
+		propagationLog.Debugf("Key not yet propagated to %d key server(s), waiting", len(missing))
+
+		select {
+		case <-pollPeriod.C:
+		case <-timeout.C:
+			propagationLog.Warnf("Key did not propagate to %d key server(s) within %s, using it anyway", len(missing), ag.propagationTimeout)
+			return nil
+		case <-cancel:
+			return errors.New("Key propagation monitor canceled")
+		}
 	}
+}
 
+// Make the candidate the pending key and publish it, unless its ID is already
+// used in the key ring, so verifiers never face an ambiguous key ID.
+func (ag *Autogenerated) publishCandidate(candidate, signingKey *key.PrivateKey, rotateInterval time.Duration) (*keyserver.PublishResult, error) {
 	ag.keyLock.Lock()
 	defer ag.keyLock.Unlock()
 
-	ag.pending = candidate
-	pendingPublic := key.NewPublicKey(ag.pending.JWK())
-
-	if signingKey == nil {
-		signingKey = ag.pending
+	if ag.keyIDInUse(candidate.ID()) {
+		return nil, errKeyIDCollision
 	}
 
 	policy := &keyserver.KeyPolicy{}
@@ -254,8 +461,50 @@ func (ag *Autogenerated) attemptPublish(signingKey *key.PrivateKey, rotateInterv
 		policy.Expiration = &expirationTime
 		policy.RotationPolicy = &rotateInterval
 	}
+	if ag.generationPath != "" {
+		// Persist the generation before publishing so it never goes backward,
+		// even if we restart in the middle of the publication. If it can't be
+		// persisted, publish the key without generation rather than failing.
+		generation := ag.generation + 1
+		if err := saveGeneration(generation, ag.generationPath); err != nil {
+			log.WithError(err).Error("Unable to persist key set generation, publishing key without it")
+		} else {
+			ag.generation = generation
+
+			log.Debug("Publishing key set generation: ", generation)
+			policy.Generation = &generation
+		}
+	}
+
+	if ag.pending != nil {
+		log.Debug("Best effort revoking unapproved key due to rotation")
+		go ag.revokeKey(ag.pending)
+	}
+
+	ag.pending = candidate
+	pendingPublic := key.NewPublicKey(ag.pending.JWK())
+
+	if signingKey == nil {
+		signingKey = ag.pending
+	}
+
+	return ag.manager.PublishPublicKey(pendingPublic, policy, signingKey), nil
+}
 
-	return ag.manager.PublishPublicKey(pendingPublic, policy, signingKey)
+// Caller MUST hold the ag.keyLock.
+func (ag *Autogenerated) keyIDInUse(keyID string) bool {
+	if ag.active != nil && ag.active.ID() == keyID {
+		return true
+	}
+	if ag.pending != nil && ag.pending.ID() == keyID {
+		return true
+	}
+	for _, retiredKeyID := range ag.retired {
+		if retiredKeyID == keyID {
+			return true
+		}
+	}
+	return false
 }
 
 // Caller MUST NOT hold the ag.keyLock.
@@ -281,6 +530,11 @@ func (ag *Autogenerated) getLogger() *log.Entry {
 
 func (ag *Autogenerated) publishAndRotate(rotateInterval time.Duration, publicationResult *keyserver.PublishResult) {
 	defer close(ag.doneCh)
+	defer func() {
+		for _, reader := range ag.propagationReaders {
+			<-reader.Stop()
+		}
+	}()
 
 	// Create a channel that will tell us when we should rotate the key,
 	// or never if `rotateInterval` is non-positive.
@@ -312,6 +566,12 @@ func (ag *Autogenerated) publishAndRotate(rotateInterval time.Duration, publicat
 				// Publication was successful, swap the pending key to active.
 				ag.keyLock.Lock()
 				toSave := ag.pending
+				if ag.active != nil {
+					ag.retired = append(ag.retired, ag.active.ID())
+					if len(ag.retired) > maxRetiredKeys {
+						ag.retired = ag.retired[len(ag.retired)-maxRetiredKeys:]
+					}
+				}
 				ag.active = ag.pending
 				ag.pending = nil
 				ag.keyLock.Unlock()
@@ -330,7 +590,7 @@ func (ag *Autogenerated) publishAndRotate(rotateInterval time.Duration, publicat
 func (ag *Autogenerated) revokeKey(toRevoke *key.PrivateKey) error {
 	err := ag.manager.DeletePublicKey(toRevoke)
 	if err != nil {
-		log.Errorf("Unable to revoke pending key: ", err)
+		log.Errorf("Unable to revoke pending key: %s", err)
 		return err
 	}
 	log.Debugf("Successfully revoked pending key")
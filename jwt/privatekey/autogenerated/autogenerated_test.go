@@ -0,0 +1,390 @@
+// Copyright 2016 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package autogenerated
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/key"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coreos/jwtproxy/config"
+	"github.com/coreos/jwtproxy/jwt/keyserver"
+	"github.com/coreos/jwtproxy/stop"
+)
+
+type testManager struct {
+	published []string
+	policies  []*keyserver.KeyPolicy
+}
+
+func (tm *testManager) VerifyPublicKey(keyID string) error {
+	return nil
+}
+
+func (tm *testManager) PublishPublicKey(key *key.PublicKey, policy *keyserver.KeyPolicy, signingKey *key.PrivateKey) *keyserver.PublishResult {
+	tm.published = append(tm.published, key.ID())
+	tm.policies = append(tm.policies, policy)
+
+	publishResult := keyserver.NewPublishResult()
+	publishResult.Success()
+	return publishResult
+}
+
+func (tm *testManager) DeletePublicKey(toRevoke *key.PrivateKey) error {
+	return nil
+}
+
+func (tm *testManager) Stop() <-chan struct{} {
+	return stop.AlreadyDone
+}
+
+// testReader is a key server that starts serving keys after being asked for
+// them a given number of times, or never if negative.
+type testReader struct {
+	lock     sync.Mutex
+	missFor  int
+	requests int
+}
+
+func (tr *testReader) GetPublicKey(issuer string, keyID string) (*key.PublicKey, error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	tr.requests++
+	if tr.missFor < 0 || tr.requests <= tr.missFor {
+		return nil, keyserver.ErrPublicKeyNotFound
+	}
+	return &key.PublicKey{}, nil
+}
+
+func (tr *testReader) Stop() <-chan struct{} {
+	return stop.AlreadyDone
+}
+
+// sequenceKeyID returns an ID scheme that gives out the specified IDs in
+// order, repeating the last one once exhausted.
+func sequenceKeyID(keyIDs ...string) keyIDScheme {
+	keyIDChan := make(chan string, len(keyIDs))
+	for _, keyID := range keyIDs {
+		keyIDChan <- keyID
+	}
+	last := keyIDs[len(keyIDs)-1]
+
+	return func(*key.PrivateKey) (string, error) {
+		select {
+		case keyID := <-keyIDChan:
+			return keyID, nil
+		default:
+			return last, nil
+		}
+	}
+}
+
+func newTestAutogenerated(keyID keyIDScheme, regenerateOnCollision bool) (*Autogenerated, *testManager) {
+	manager := &testManager{}
+	return &Autogenerated{
+		active:                &key.PrivateKey{KeyID: "active"},
+		retired:               []string{"retired"},
+		manager:               manager,
+		generator:             newGenerator(1),
+		keyID:                 keyID,
+		regenerateOnCollision: regenerateOnCollision,
+	}, manager
+}
+
+func TestKeyIDUniqueness(t *testing.T) {
+	// Unique key IDs get published.
+	ag, manager := newTestAutogenerated(sequenceKeyID("unique"), false)
+	assert.Nil(t, <-ag.attemptPublish(nil, 0).Result())
+	assert.Equal(t, []string{"unique"}, manager.published)
+	assert.Equal(t, "unique", ag.pending.ID())
+	ag.generator.Stop()
+
+	// Key IDs colliding with the active, pending or retired keys are refused.
+	ag, manager = newTestAutogenerated(sequenceKeyID("active"), false)
+	assert.Equal(t, errKeyIDCollision, <-ag.attemptPublish(nil, 0).Result())
+	assert.Empty(t, manager.published)
+	ag.generator.Stop()
+
+	ag, manager = newTestAutogenerated(sequenceKeyID("retired"), false)
+	assert.Equal(t, errKeyIDCollision, <-ag.attemptPublish(nil, 0).Result())
+	assert.Empty(t, manager.published)
+	ag.generator.Stop()
+
+	ag, manager = newTestAutogenerated(sequenceKeyID("pending"), false)
+	ag.pending = &key.PrivateKey{KeyID: "pending"}
+	assert.Equal(t, errKeyIDCollision, <-ag.attemptPublish(nil, 0).Result())
+	assert.Empty(t, manager.published)
+	ag.generator.Stop()
+
+	// Colliding keys may be regenerated instead, a bounded number of times.
+	ag, manager = newTestAutogenerated(sequenceKeyID("active", "retired", "unique"), true)
+	assert.Nil(t, <-ag.attemptPublish(nil, 0).Result())
+	assert.Equal(t, []string{"unique"}, manager.published)
+	ag.generator.Stop()
+
+	ag, manager = newTestAutogenerated(sequenceKeyID("active"), true)
+	assert.Equal(t, errKeyIDCollision, <-ag.attemptPublish(nil, 0).Result())
+	assert.Empty(t, manager.published)
+	ag.generator.Stop()
+}
+
+func TestGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy-generation")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	generationPath := path.Join(dir, "mykey.generation")
+
+	// The generation increments and is persisted on every publication.
+	ag, manager := newTestAutogenerated(sequenceKeyID("first", "second"), false)
+	ag.generationPath = generationPath
+	assert.Nil(t, <-ag.attemptPublish(nil, 0).Result())
+	assert.Nil(t, <-ag.attemptPublish(nil, 0).Result())
+	ag.generator.Stop()
+	if assert.Len(t, manager.policies, 2) {
+		assert.Equal(t, uint64(1), *manager.policies[0].Generation)
+		assert.Equal(t, uint64(2), *manager.policies[1].Generation)
+	}
+
+	// It resumes from where it left off after a restart, or from zero if it
+	// never published any generation.
+	generation, err := resumeGeneration(generationPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), generation)
+	generation, err = resumeGeneration(path.Join(dir, "missing.generation"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), generation)
+
+	// An unreadable generation file prevents starting, as starting over would
+	// make the generation go backward.
+	assert.Nil(t, ioutil.WriteFile(generationPath, []byte("18446744073709551616"), 0600))
+	_, err = resumeGeneration(generationPath)
+	assert.NotNil(t, err)
+	assert.Nil(t, ioutil.WriteFile(generationPath, []byte("garbage"), 0600))
+	_, err = resumeGeneration(generationPath)
+	assert.NotNil(t, err)
+
+	_, err = constructor(config.RegistrableComponentConfig{
+		Options: map[string]interface{}{
+			"key_folder":         dir,
+			"publish_generation": true,
+		},
+	}, config.SignerParams{Issuer: "mykey"})
+	assert.NotNil(t, err)
+
+	// Keys are published without generation if it can not be persisted.
+	ag, manager = newTestAutogenerated(sequenceKeyID("unique"), false)
+	ag.generationPath = path.Join(generationPath, "notadirectory")
+	assert.Nil(t, <-ag.attemptPublish(nil, 0).Result())
+	if assert.Len(t, manager.policies, 1) {
+		assert.Nil(t, manager.policies[0].Generation)
+	}
+	assert.Equal(t, uint64(0), ag.generation)
+	ag.generator.Stop()
+}
+
+// blockingKeyID returns an ID scheme that counts the keys being identified,
+// tracking the maximum seen concurrently, and blocks until released.
+type blockingKeyID struct {
+	lock       sync.Mutex
+	started    int
+	running    int
+	maxRunning int
+	release    chan struct{}
+}
+
+func (b *blockingKeyID) keyID(*key.PrivateKey) (string, error) {
+	b.lock.Lock()
+	b.started++
+	b.running++
+	if b.running > b.maxRunning {
+		b.maxRunning = b.running
+	}
+	b.lock.Unlock()
+
+	<-b.release
+
+	b.lock.Lock()
+	b.running--
+	b.lock.Unlock()
+	return "blocked", nil
+}
+
+func (b *blockingKeyID) waitStarted(t *testing.T, started int) {
+	waitFor(t, "key generations to start", func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return b.started >= started
+	})
+}
+
+// waitFor waits until the condition holds, failing the test if it takes too
+// long.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestGenerator(t *testing.T) {
+	// Keys are generated in the order they are requested.
+	g := newGenerator(1)
+	keyID := sequenceKeyID("first", "second", "third")
+	for _, expected := range []string{"first", "second", "third"} {
+		generated := <-g.Generate(keyID, nil)
+		if assert.Nil(t, generated.err) {
+			assert.Equal(t, expected, generated.key.ID())
+		}
+	}
+	g.Stop()
+
+	// No more keys than workers are generated concurrently.
+	g = newGenerator(2)
+	blocking := &blockingKeyID{release: make(chan struct{})}
+	results := make(chan generatedKey, 5)
+	for i := 0; i < 5; i++ {
+		go func() { results <- <-g.Generate(blocking.keyID, nil) }()
+	}
+	blocking.waitStarted(t, 2)
+	time.Sleep(100 * time.Millisecond)
+	close(blocking.release)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, (<-results).err)
+	}
+	assert.Equal(t, 2, blocking.maxRunning)
+
+	// The first size applies: later ones can not raise the limit.
+	g.startWorkers(1)
+	assert.Equal(t, 2, g.workers)
+	g.startWorkers(3)
+	assert.Equal(t, 2, g.workers)
+	g.Stop()
+
+	// Queued requests are dropped if canceled or if the generator stops.
+	g = newGenerator(1)
+	blocking = &blockingKeyID{release: make(chan struct{})}
+	first := make(chan generatedKey, 1)
+	go func() { first <- <-g.Generate(blocking.keyID, nil) }()
+	blocking.waitStarted(t, 1)
+
+	cancel := make(chan struct{})
+	canceled := make(chan generatedKey, 1)
+	go func() { canceled <- <-g.Generate(blocking.keyID, cancel) }()
+	stopped := make(chan generatedKey, 1)
+	go func() { stopped <- <-g.Generate(blocking.keyID, nil) }()
+
+	close(cancel)
+	assert.Equal(t, errGenerationCanceled, (<-canceled).err)
+	g.Stop()
+	assert.NotNil(t, (<-stopped).err)
+
+	close(blocking.release)
+	assert.Nil(t, (<-first).err)
+	assert.Equal(t, 1, blocking.started)
+}
+
+func TestPropagation(t *testing.T) {
+	published := &key.PrivateKey{KeyID: "published-key"}
+	newPropagationAutogenerated := func(timeout time.Duration, readers ...*testReader) *Autogenerated {
+		ag, _ := newTestAutogenerated(sequenceKeyID("unused"), false)
+		ag.generator.Stop()
+		for _, reader := range readers {
+			ag.propagationReaders = append(ag.propagationReaders, reader)
+		}
+		ag.propagationTimeout = timeout
+		ag.propagationPoll = 10 * time.Millisecond
+		return ag
+	}
+
+	// Succeeds once every key server serves the key.
+	immediate, lagging := &testReader{}, &testReader{missFor: 3}
+	ag := newPropagationAutogenerated(10*time.Second, immediate, lagging)
+	assert.Nil(t, ag.awaitPropagation(published, nil))
+	assert.Equal(t, 1, immediate.requests)
+	assert.Equal(t, 4, lagging.requests)
+
+	// Gives up waiting after the timeout, but still lets the key be used.
+	start := time.Now()
+	ag = newPropagationAutogenerated(50*time.Millisecond, &testReader{missFor: -1})
+	assert.Nil(t, ag.awaitPropagation(published, nil))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Stops waiting when canceled.
+	cancel := make(chan struct{})
+	close(cancel)
+	ag = newPropagationAutogenerated(10*time.Second, &testReader{missFor: -1})
+	assert.NotNil(t, ag.awaitPropagation(published, cancel))
+}
+
+func TestPropagatedPromotion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy-propagation")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, timeout := range []time.Duration{10 * time.Second, 50 * time.Millisecond} {
+		ag, _ := newTestAutogenerated(sequenceKeyID("published-key"), false)
+		reader := &testReader{missFor: -1}
+		ag.propagationReaders = []keyserver.Reader{reader}
+		ag.propagationTimeout = timeout
+		ag.propagationPoll = 10 * time.Millisecond
+		ag.stopCh, ag.doneCh = make(chan struct{}), make(chan struct{})
+		ag.keyPath = path.Join(dir, "mykey.jwk")
+
+		go ag.publishAndRotate(0, ag.attemptPublish(ag.active, 0))
+		activeKeyID := func() string {
+			active, err := ag.GetPrivateKey()
+			assert.Nil(t, err)
+			return active.ID()
+		}
+
+		if timeout > time.Second {
+			// The published key is pending, while the active key keeps
+			// signing, until it propagated.
+			waitFor(t, "the key propagation to be checked", func() bool {
+				reader.lock.Lock()
+				defer reader.lock.Unlock()
+				return reader.requests > 0
+			})
+			ag.keyLock.Lock()
+			assert.Equal(t, "published-key", ag.pending.ID())
+			ag.keyLock.Unlock()
+			assert.Equal(t, "active", activeKeyID())
+
+			reader.lock.Lock()
+			reader.missFor = 0
+			reader.lock.Unlock()
+		}
+
+		// The propagated key, or the one that failed to propagate in time,
+		// becomes active and the previous one is retired.
+		waitFor(t, "the key promotion", func() bool { return activeKeyID() == "published-key" })
+		ag.keyLock.Lock()
+		assert.Nil(t, ag.pending)
+		assert.Equal(t, []string{"retired", "active"}, ag.retired)
+		ag.keyLock.Unlock()
+
+		<-ag.Stop()
+		ag.generator.Stop()
+	}
+}
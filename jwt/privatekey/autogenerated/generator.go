@@ -0,0 +1,154 @@
+// Copyright 2016 CoreOS, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package autogenerated
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/key"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+var errGenerationCanceled = errors.New("Key generation canceled")
+
+type generatedKey struct {
+	key *key.PrivateKey
+	err error
+}
+
+// generationRequest is a queued request for a new private key.
+type generationRequest struct {
+	keyID  keyIDScheme
+	cancel <-chan struct{}
+	result chan<- generatedKey
+}
+
+// generator generates private keys on a bounded pool of workers, so a burst of
+// rotations can not use up more than that many CPUs.
+type generator struct {
+	requests chan generationRequest
+	stopCh   chan struct{}
+
+	lock    sync.Mutex
+	workers int
+}
+
+// keyIDScheme computes the ID of a newly generated private key.
+type keyIDScheme func(*key.PrivateKey) (string, error)
+
+// sharedGenerator generates the keys of all the autogenerated private keys of
+// the process, so their workers bound the CPU used by key generation overall.
+// It is sized by the first of them to be constructed.
+var sharedGenerator = newGenerator(0)
+
+func newGenerator(workers int) *generator {
+	g := &generator{
+		requests: make(chan generationRequest),
+		stopCh:   make(chan struct{}),
+	}
+	g.startWorkers(workers)
+	return g
+}
+
+// startWorkers starts the specified number of workers, unless the generator
+// already has some: its size is then kept, as it bounds the CPU used overall.
+func (g *generator) startWorkers(workers int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.workers > 0 {
+		if workers != g.workers {
+			log.Warnf("Key generation already uses %d worker(s) process-wide, ignoring the configured %d", g.workers, workers)
+		}
+		return
+	}
+	for ; g.workers < workers; g.workers++ {
+		go g.work()
+	}
+}
+
+// Generate queues the generation of a new private key, identified using the
+// given scheme, and blocks until a worker picks it up. The key is delivered on
+// the returned channel once generated. Canceled requests are dropped.
+func (g *generator) Generate(keyID keyIDScheme, cancel <-chan struct{}) <-chan generatedKey {
+	result := make(chan generatedKey, 1)
+	select {
+	case g.requests <- generationRequest{keyID: keyID, cancel: cancel, result: result}:
+	case <-cancel:
+		result <- generatedKey{err: errGenerationCanceled}
+	case <-g.stopCh:
+		result <- generatedKey{err: errors.New("Key generator stopped")}
+	}
+	return result
+}
+
+func (g *generator) Stop() {
+	close(g.stopCh)
+}
+
+func (g *generator) work() {
+	for {
+		select {
+		case request := <-g.requests:
+			// The request may have been canceled while being picked up.
+			select {
+			case <-request.cancel:
+				request.result <- generatedKey{err: errGenerationCanceled}
+				continue
+			default:
+			}
+
+			candidate, err := generatePrivateKey(request.keyID)
+			request.result <- generatedKey{key: candidate, err: err}
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+// generatePrivateKey generates a new private key, identified using the given
+// scheme.
+func generatePrivateKey(keyID keyIDScheme) (*key.PrivateKey, error) {
+	candidate, err := key.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	candidate.KeyID, err = keyID(candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	return candidate, nil
+}
+
+// thumbprintKeyID identifies private keys by the thumbprint of their JWK.
+func thumbprintKeyID(pk *key.PrivateKey) (string, error) {
+	jwk := jose.JSONWebKey{
+		Key:       pk.PrivateKey,
+		KeyID:     pk.KeyID,
+		Algorithm: "rsa",
+		Use:       "",
+	}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(thumbprint), nil
+}
@@ -15,14 +15,19 @@
 package jwt
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
 	"github.com/coreos/goproxy"
 
 	"github.com/coreos/jwtproxy/config"
@@ -36,7 +41,20 @@ import (
 
 type StoppableProxyHandler struct {
 	proxy.Handler
-	stopFunc func() <-chan struct{}
+	ResponseHandler proxy.ResponseHandler
+	stopFunc        func() <-chan struct{}
+}
+
+// verifiedRequest is kept in the goproxy.ProxyCtx of the requests that have
+// been successfully verified so the response handler can act upon them.
+type verifiedRequest struct {
+	claims jose.Claims
+
+	// logger is only set if the claims matched the configured log filter.
+	logger *log.Entry
+
+	// cacheControl is the Cache-Control header to set on the response, if any.
+	cacheControl string
 }
 
 func NewJWTSignerHandler(cfg config.SignerConfig) (*StoppableProxyHandler, error) {
@@ -44,6 +62,23 @@ func NewJWTSignerHandler(cfg config.SignerConfig) (*StoppableProxyHandler, error
 	if cfg.PrivateKey.Type == "" {
 		return nil, errors.New("no private key provider specified")
 	}
+	if cfg.LoadShedding.MaxSigningLatency > 0 && (cfg.LoadShedding.Decay <= 0 || cfg.LoadShedding.Decay > 1) {
+		return nil, errors.New("load shedding decay must be in (0, 1]")
+	}
+
+	// Determine the claims marking the tokens of legacy clients. YAML decodes
+	// nested mappings with interface{} keys, that can not be encoded as JSON.
+	var legacyClaims map[string]interface{}
+	if cfg.Legacy.Enabled {
+		if len(cfg.Legacy.Claims) == 0 {
+			return nil, errors.New("no legacy claims specified")
+		}
+		claims, err := jsonValue(cfg.Legacy.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("invalid legacy claims: %s", err)
+		}
+		legacyClaims = claims.(map[string]interface{})
+	}
 
 	// Get the private key that will be used for signing.
 	privateKeyProvider, err := privatekey.New(cfg.PrivateKey, cfg.SignerParams)
@@ -51,23 +86,48 @@ func NewJWTSignerHandler(cfg config.SignerConfig) (*StoppableProxyHandler, error
 		return nil, err
 	}
 
-	// Create a proxy.Handler that will add a JWT to http.Requests.
-	handler := func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	// Create a load shedder if the signer should protect itself against overload.
+	var shedder *loadShedder
+	if cfg.LoadShedding.MaxSigningLatency > 0 {
+		shedder = newLoadShedder(cfg.LoadShedding)
+	}
+
+	return &StoppableProxyHandler{
+		Handler:  signerHandler(cfg.SignerParams, privateKeyProvider, shedder, legacyClaims),
+		stopFunc: privateKeyProvider.Stop,
+	}, nil
+}
+
+// signerHandler creates a proxy.Handler that will add a JWT to http.Requests.
+// If legacyClaims is set, the requests already carrying a bearer token are
+// forwarded untouched, while the others get a JWT having these claims.
+func signerHandler(params config.SignerParams, privateKeyProvider privatekey.PrivateKey, shedder *loadShedder, legacyClaims map[string]interface{}) proxy.Handler {
+	return func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if legacyClaims != nil {
+			if _, err := oidc.ExtractBearerToken(r); err == nil {
+				return r, nil
+			}
+		}
+
+		if shedder.shouldShed() {
+			resp := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusServiceUnavailable, "jwtproxy: signer is overloaded, try again later")
+			resp.Header.Set("Retry-After", "1")
+			return r, resp
+		}
+
+		start := time.Now()
+		defer func() { shedder.observe(time.Since(start)) }()
+
 		privateKey, err := privateKeyProvider.GetPrivateKey()
 		if err != nil {
 			return r, errorResponse(r, err)
 		}
 
-		if err := Sign(r, privateKey, cfg.SignerParams); err != nil {
+		if err := signWithClaims(r, privateKey, params, legacyClaims); err != nil {
 			return r, errorResponse(r, err)
 		}
 		return r, nil
 	}
-
-	return &StoppableProxyHandler{
-		Handler:  handler,
-		stopFunc: privateKeyProvider.Stop,
-	}, nil
 }
 
 func NewJWTVerifierHandler(cfg config.VerifierConfig) (*StoppableProxyHandler, error) {
@@ -75,12 +135,20 @@ func NewJWTVerifierHandler(cfg config.VerifierConfig) (*StoppableProxyHandler, e
 	if cfg.Upstream.URL == nil {
 		return nil, errors.New("no upstream specified")
 	}
-	if cfg.Audience.URL == nil {
+	if cfg.Audience.URL == nil && !cfg.AudMustMatchHost {
 		return nil, errors.New("no audience specified")
 	}
 	if cfg.KeyServer.Type == "" {
 		return nil, errors.New("no key server specified")
 	}
+	if cfg.Refresh.Enabled {
+		if cfg.Refresh.Signer.PrivateKey.Type == "" {
+			return nil, errors.New("no private key provider specified for refresh")
+		}
+		if cfg.Refresh.Signer.ExpirationTime > cfg.MaxTTL {
+			return nil, errors.New("refreshed JWTs would expire later than the max TTL allows")
+		}
+	}
 
 	stopper := stop.NewGroup()
 
@@ -98,9 +166,28 @@ func NewJWTVerifierHandler(cfg config.VerifierConfig) (*StoppableProxyHandler, e
 	}
 	stopper.Add(nonceStorage)
 
+	// Get the private key that will be used for signing refreshed JWTs.
+	var refreshKeyProvider privatekey.PrivateKey
+	if cfg.Refresh.Enabled {
+		refreshKeyProvider, err = privatekey.New(cfg.Refresh.Signer.PrivateKey, cfg.Refresh.Signer.SignerParams)
+		if err != nil {
+			return nil, err
+		}
+		stopper.Add(refreshKeyProvider)
+	}
+
 	// Create an appropriate routing policy.
 	route := newRouter(cfg.Upstream.URL)
 
+	// Index the audiences of the hosts, as Host headers are case-insensitive.
+	hostAudiences := make(map[string]*url.URL, len(cfg.HostAudiences))
+	for host, audience := range cfg.HostAudiences {
+		if audience.URL == nil {
+			return nil, fmt.Errorf("no audience specified for host %q", host)
+		}
+		hostAudiences[strings.ToLower(host)] = audience.URL
+	}
+
 	// Create the required list of claims.Verifier.
 	var claimsVerifiers []claims.Verifier
 	if cfg.ClaimsVerifiers != nil {
@@ -121,28 +208,97 @@ func NewJWTVerifierHandler(cfg config.VerifierConfig) (*StoppableProxyHandler, e
 
 	// Create a reverse proxy.Handler that will verify JWT from http.Requests.
 	handler := func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		signedClaims, err := Verify(r, keyServer, nonceStorage, cfg.Audience.URL, cfg.MaxSkew, cfg.MaxTTL)
+		audience := cfg.Audience.URL
+		if cfg.AudMustMatchHost {
+			audience = hostAudience(r, hostAudiences)
+		}
+
+		// Refresh requests may present expired JWTs and must present JWTs that are about to expire.
+		isRefresh := cfg.Refresh.Enabled && r.URL.Path == cfg.Refresh.Path
+		var expGrace, maxRemaining time.Duration
+		if isRefresh {
+			expGrace, maxRemaining = cfg.Refresh.Grace, cfg.Refresh.MaxRemaining
+		}
+
+		signedClaims, err := verify(r, keyServer, nonceStorage, audience, cfg.MaxSkew, cfg.MaxTTL, expGrace, maxRemaining)
 		if err != nil {
 			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, fmt.Sprintf("jwtproxy: unable to verify request: %s", err))
 		}
 
+		verified := &verifiedRequest{claims: signedClaims}
+		if len(cfg.LogFilter) > 0 && claimsMatch(signedClaims, cfg.LogFilter) {
+			verified.logger = log.WithFields(log.Fields{
+				"method":     r.Method,
+				"host":       r.Host,
+				"path":       r.URL.Path,
+				"remoteAddr": r.RemoteAddr,
+				"claims":     loggedClaims(signedClaims, cfg.LogFilter),
+			})
+			verified.logger.Info("Verified request matching log filter")
+		}
+
 		// Run through the claims verifiers.
 		for _, verifier := range claimsVerifiers {
 			err := verifier.Handle(r, signedClaims)
 			if err != nil {
+				if verified.logger != nil {
+					verified.logger.WithError(err).Info("Request matching log filter rejected by claims verifier")
+				}
 				return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, fmt.Sprintf("Error verifying claims: %s", err))
 			}
 		}
 
+		// Answer refresh requests ourselves.
+		if isRefresh {
+			return r, refreshResponse(r, signedClaims, refreshKeyProvider, cfg.Refresh.Signer.SignerParams)
+		}
+
+		// Determine whether the response should be kept away from shared caches, before the
+		// request's path gets rewritten by the router.
+		if cfg.CacheControl.Value != "" && !hasAnyPrefix(r.URL.Path, cfg.CacheControl.ExemptPaths) {
+			verified.cacheControl = cfg.CacheControl.Value
+		}
+
 		// Route the request to upstream.
+		ctx.UserData = verified
 		route(r, ctx)
 
 		return r, nil
 	}
 
+	// Create a proxy.ResponseHandler that will decorate the upstream's responses to the verified
+	// requests.
+	responseHandler := func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		verified, ok := ctx.UserData.(*verifiedRequest)
+		if !ok {
+			return resp
+		}
+
+		if verified.logger != nil {
+			if resp == nil {
+				verified.logger.WithError(ctx.Error).Info("Upstream failed to respond to request matching log filter")
+			} else {
+				verified.logger.WithField("status", resp.StatusCode).Info("Upstream responded to request matching log filter")
+			}
+		}
+		if resp == nil {
+			return resp
+		}
+
+		if verified.cacheControl != "" && (cfg.CacheControl.Override || !preventsSharedCaching(resp.Header.Get("Cache-Control"))) {
+			resp.Header.Set("Cache-Control", verified.cacheControl)
+		}
+		if cfg.ClaimsTrailer != "" {
+			addClaimsTrailer(resp, ctx.Req, cfg.ClaimsTrailer, verified.claims)
+		}
+
+		return resp
+	}
+
 	return &StoppableProxyHandler{
-		Handler:  handler,
-		stopFunc: stopper.Stop,
+		Handler:         handler,
+		ResponseHandler: responseHandler,
+		stopFunc:        stopper.Stop,
 	}, nil
 }
 
@@ -150,6 +306,181 @@ func (sph *StoppableProxyHandler) Stop() <-chan struct{} {
 	return sph.stopFunc()
 }
 
+// preventsSharedCaching returns whether the specified Cache-Control header already keeps shared
+// caches from storing the response, i.e. has a bare private or a no-store directive.
+func preventsSharedCaching(cacheControl string) bool {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "private", "no-store":
+			return true
+		}
+	}
+	return false
+}
+
+// addClaimsTrailer announces the specified trailer on the response and sets it to the
+// base64url-encoded JSON representation of the verified claims.
+// Trailers are only transmitted in chunked HTTP/1.1 (or HTTP/2) bodies: the Content-Length is
+// therefore dropped so the response gets chunked, and nothing is added for HTTP/1.0 clients or
+// for responses that can not have a body.
+func addClaimsTrailer(resp *http.Response, r *http.Request, name string, claims jose.Claims) {
+	if !r.ProtoAtLeast(1, 1) || r.Method == "HEAD" || !bodyAllowedForStatus(resp.StatusCode) {
+		return
+	}
+
+	encodedClaims, err := json.Marshal(claims)
+	if err != nil {
+		log.Errorf("Could not encode verified claims for trailer: %s", err)
+		return
+	}
+
+	name = http.CanonicalHeaderKey(name)
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Trailer", name)
+	resp.Header.Set(http.TrailerPrefix+name, base64.RawURLEncoding.EncodeToString(encodedClaims))
+}
+
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// hostAudience returns the audience that the JWT of a request must have been signed for, based
+// on the host it has been sent to: it is either explicitly mapped to the host, or derived from it
+// the same way the signer does.
+func hostAudience(r *http.Request, hostAudiences map[string]*url.URL) *url.URL {
+	if audience, ok := hostAudiences[strings.ToLower(r.Host)]; ok {
+		return audience
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// loggedClaims returns the subset of the claims that may be logged for requests
+// matching the log filter: the filtered claims themselves, plus the subject and
+// issuer. Other claims may carry sensitive data and are left out.
+func loggedClaims(claims jose.Claims, filter map[string]string) jose.Claims {
+	logged := make(jose.Claims, len(filter)+2)
+	for _, name := range []string{"sub", "iss"} {
+		if value, ok := claims[name]; ok {
+			logged[name] = value
+		}
+	}
+	for name := range filter {
+		if value, ok := claims[name]; ok {
+			logged[name] = value
+		}
+	}
+	return logged
+}
+
+// jsonValue converts a value decoded from YAML to one that can be encoded as
+// JSON, by converting the keys of its mappings to strings.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			convertedValue, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			converted[key] = convertedValue
+		}
+		return converted, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			stringKey, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", key)
+			}
+			convertedValue, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			converted[stringKey] = convertedValue
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, value := range v {
+			convertedValue, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = convertedValue
+		}
+		return converted, nil
+	default:
+		return value, nil
+	}
+}
+
+// claimsMatch returns whether every claim of the filter is present with the given value. Claims
+// that are arrays (e.g. audiences) match if any of their elements has the given value.
+func claimsMatch(claims jose.Claims, filter map[string]string) bool {
+	for name, expected := range filter {
+		value, ok := claims[name]
+		if !ok {
+			return false
+		}
+
+		matched := false
+		if values, isArray := value.([]interface{}); isArray {
+			for _, v := range values {
+				if fmt.Sprint(v) == expected {
+					matched = true
+					break
+				}
+			}
+		} else {
+			matched = fmt.Sprint(value) == expected
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func refreshResponse(r *http.Request, claims jose.Claims, privateKeyProvider privatekey.PrivateKey, params config.SignerParams) *http.Response {
+	privateKey, err := privateKeyProvider.GetPrivateKey()
+	if err != nil {
+		log.Errorf("Could not get private key to refresh JWT: %s", err)
+		return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusServiceUnavailable, "jwtproxy: unable to refresh JWT")
+	}
+
+	token, err := Refresh(claims, privateKey, params)
+	if err != nil {
+		log.Errorf("Could not sign refreshed JWT: %s", err)
+		return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusInternalServerError, "jwtproxy: unable to refresh JWT")
+	}
+
+	body, _ := json.Marshal(map[string]string{"token": token})
+	resp := goproxy.NewResponse(r, "application/json", http.StatusOK, string(body))
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
 func errorResponse(r *http.Request, err error) *http.Response {
 	return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("jwtproxy: unable to sign request: %s", err))
 }
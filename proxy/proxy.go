@@ -34,6 +34,8 @@ import (
 
 type Handler func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response)
 
+type ResponseHandler func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response
+
 type Proxy struct {
 	*goproxy.ProxyHttpServer
 	grace           *graceful.Server
@@ -134,7 +136,7 @@ func NewProxy(proxyHandler Handler, caKeyPath, caCertPath string, insecureSkipVe
 	return &Proxy{ProxyHttpServer: proxy}, nil
 }
 
-func NewReverseProxy(proxyHandler Handler) (*Proxy, error) {
+func NewReverseProxy(proxyHandler Handler, responseHandler ResponseHandler) (*Proxy, error) {
 	// Create a reverse proxy.
 	reverseProxy := goproxy.NewReverseProxyHttpServer()
 	reverseProxy.Tr = http.DefaultTransport.(*http.Transport)
@@ -142,6 +144,9 @@ func NewReverseProxy(proxyHandler Handler) (*Proxy, error) {
 
 	// Handle requests with the specified handler.
 	reverseProxy.OnRequest().DoFunc(proxyHandler)
+	if responseHandler != nil {
+		reverseProxy.OnResponse().DoFunc(responseHandler)
+	}
 
 	return &Proxy{ProxyHttpServer: reverseProxy}, nil
 }